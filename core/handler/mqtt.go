@@ -9,16 +9,34 @@ import (
 	ttnlog "github.com/TheThingsNetwork/go-utils/log"
 	"github.com/TheThingsNetwork/ttn/core/types"
 	"github.com/TheThingsNetwork/ttn/mqtt"
+	"github.com/TheThingsNetwork/ttn/utils/errors"
 )
 
-// MQTTTimeout indicates how long we should wait for an MQTT publish
+// MQTTTimeout indicates how long we should wait for an MQTT publish or subscription.
+// If it is zero, HandleMQTT waits indefinitely.
 var MQTTTimeout = 2 * time.Second
 
 // MQTTBufferSize indicates the size for uplink channel buffers
 var MQTTBufferSize = 10
 
+// newMQTTClient creates the MQTT client used by HandleMQTT
+var newMQTTClient = mqtt.NewClient
+
 func (h *handler) HandleMQTT(username, password string, mqttBrokers ...string) error {
-	h.mqttClient = mqtt.NewClient(h.Ctx, "ttnhdl", username, password, mqttBrokers...)
+	return h.handleMQTT(MQTTTimeout, username, password, mqttBrokers...)
+}
+
+// waitMQTT waits for the token to complete, or at most for the timeout if it is not zero
+func waitMQTT(token mqtt.Token, timeout time.Duration) bool {
+	if timeout == 0 {
+		return token.Wait()
+	}
+	return token.WaitTimeout(timeout)
+}
+
+// handleMQTT connects to MQTT and waits at most timeout for each subscription and publish, or indefinitely if it is zero
+func (h *handler) handleMQTT(timeout time.Duration, username, password string, mqttBrokers ...string) error {
+	h.mqttClient = newMQTTClient(h.Ctx, "ttnhdl", username, password, mqttBrokers...)
 
 	err := h.mqttClient.Connect()
 	if err != nil {
@@ -34,8 +52,10 @@ func (h *handler) HandleMQTT(username, password string, mqttBrokers ...string) e
 		down.AppID = appID
 		go h.EnqueueDownlink(down)
 	})
-	token.Wait()
-	if token.Error() != nil {
+	if !waitMQTT(token, timeout) {
+		return errors.New("Timeout while subscribing to MQTT downlink")
+	}
+	if err := token.Error(); err != nil {
 		return err
 	}
 
@@ -50,7 +70,7 @@ func (h *handler) HandleMQTT(username, password string, mqttBrokers ...string) e
 			ctx.Debug("Publish Uplink")
 			upToken := h.mqttClient.PublishUplink(*up)
 			go func(ctx ttnlog.Interface) {
-				if upToken.WaitTimeout(MQTTTimeout) {
+				if waitMQTT(upToken, timeout) {
 					if upToken.Error() != nil {
 						ctx.WithError(upToken.Error()).Warn("Could not publish Uplink")
 					}
@@ -61,7 +81,7 @@ func (h *handler) HandleMQTT(username, password string, mqttBrokers ...string) e
 			if len(up.PayloadFields) > 0 {
 				fieldsToken := h.mqttClient.PublishUplinkFields(up.AppID, up.DevID, up.PayloadFields)
 				go func(ctx ttnlog.Interface) {
-					if fieldsToken.WaitTimeout(MQTTTimeout) {
+					if waitMQTT(fieldsToken, timeout) {
 						if fieldsToken.Error() != nil {
 							ctx.WithError(fieldsToken.Error()).Warn("Could not publish Uplink Fields")
 						}
@@ -88,7 +108,7 @@ func (h *handler) HandleMQTT(username, password string, mqttBrokers ...string) e
 				token = h.mqttClient.PublishDeviceEvent(event.AppID, event.DevID, event.Event, event.Data)
 			}
 			go func() {
-				if token.WaitTimeout(MQTTTimeout) {
+				if waitMQTT(token, timeout) {
 					if token.Error() != nil {
 						ctx.WithError(token.Error()).Warn("Could not publish Event")
 					}
@@ -9,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/TheThingsNetwork/go-utils/log"
 	"github.com/TheThingsNetwork/ttn/core/component"
 	"github.com/TheThingsNetwork/ttn/core/handler/device"
 	"github.com/TheThingsNetwork/ttn/core/types"
@@ -86,3 +87,52 @@ func TestHandleMQTT(t *testing.T) {
 
 	a.So(wg.WaitFor(200*time.Millisecond), ShouldBeNil)
 }
+
+// fakeMQTTClient is an MQTT client whose downlink subscription completes with the configured token
+type fakeMQTTClient struct {
+	mqtt.Client
+	subscribeToken mqtt.Token
+}
+
+func (c fakeMQTTClient) Connect() error { return nil }
+func (c fakeMQTTClient) SubscribeDownlink(handler mqtt.DownlinkHandler) mqtt.Token {
+	return c.subscribeToken
+}
+
+// delayedMQTTToken is an MQTT token that completes after the delay
+type delayedMQTTToken struct {
+	delay time.Duration
+}
+
+func (t delayedMQTTToken) Wait() bool {
+	<-time.After(t.delay)
+	return true
+}
+func (t delayedMQTTToken) WaitTimeout(d time.Duration) bool {
+	if d < t.delay {
+		<-time.After(d)
+		return false
+	}
+	return t.Wait()
+}
+func (t delayedMQTTToken) Error() error { return nil }
+
+func TestHandleMQTTSubscribeTimeout(t *testing.T) {
+	a := New(t)
+
+	defer func(f func(log.Interface, string, string, string, ...string) mqtt.Client) { newMQTTClient = f }(newMQTTClient)
+	newMQTTClient = func(ctx log.Interface, id, username, password string, brokers ...string) mqtt.Client {
+		return fakeMQTTClient{subscribeToken: delayedMQTTToken{delay: 200 * time.Millisecond}}
+	}
+
+	h := &handler{
+		Component: &component.Component{Ctx: GetLogger(t, "TestHandleMQTTSubscribeTimeout")},
+	}
+	err := h.handleMQTT(50*time.Millisecond, "", "", "tcp://localhost:1883")
+	a.So(err, ShouldNotBeNil)
+	a.So(err.Error(), ShouldContainSubstring, "Timeout while subscribing")
+
+	// A zero timeout waits until the subscription completes
+	err = h.handleMQTT(0, "", "", "tcp://localhost:1883")
+	a.So(err, ShouldBeNil)
+}
@@ -5,6 +5,7 @@ package mqtt
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -23,6 +24,10 @@ var (
 	SubscribeQoS byte = 0x00
 )
 
+// MaxTopicLength is the maximum length (in bytes) of topics that the client publishes or subscribes to.
+// It defaults to the limit of the MQTT protocol (65535 bytes); set it lower for brokers that impose a stricter limit.
+var MaxTopicLength = 65535
+
 // Client connects to the MQTT server and can publish/subscribe on uplink, downlink and activations from devices
 type Client interface {
 	Connect() error
@@ -30,6 +35,9 @@ type Client interface {
 
 	IsConnected() bool
 
+	// SetWill configures the message that the broker publishes if the client disconnects ungracefully
+	SetWill(topic string, payload []byte, qos byte, retained bool) error
+
 	// Uplink pub/sub
 	PublishUplink(payload types.UplinkMessage) Token
 	PublishUplinkFields(appID string, devID string, fields map[string]interface{}) Token
@@ -144,10 +152,11 @@ func (t *token) Error() error {
 
 // DefaultClient is the default MQTT client for The Things Network
 type DefaultClient struct {
-	opts          *MQTT.ClientOptions
-	mqtt          MQTT.Client
-	ctx           log.Interface
-	subscriptions map[string]MQTT.MessageHandler
+	opts              *MQTT.ClientOptions
+	mqtt              MQTT.Client
+	ctx               log.Interface
+	subscriptions     map[string]MQTT.MessageHandler
+	subscriptionsLock sync.RWMutex
 }
 
 // NewClient creates a new DefaultClient
@@ -170,9 +179,10 @@ func NewClient(ctx log.Interface, id, username, password string, brokers ...stri
 	ttnClient.opts.SetUsername(username)
 	ttnClient.opts.SetPassword(password)
 
-	// TODO: Some tuning of these values probably won't hurt:
-	ttnClient.opts.SetKeepAlive(30 * time.Second)
-	ttnClient.opts.SetPingTimeout(10 * time.Second)
+	ttnClient.opts.SetKeepAlive(KeepAlive)
+	ttnClient.opts.SetPingTimeout(PingTimeout)
+	ttnClient.opts.SetConnectTimeout(ConnectTimeout)
+	ttnClient.opts.SetMaxReconnectInterval(MaxReconnectInterval)
 
 	ttnClient.opts.SetCleanSession(true)
 
@@ -189,11 +199,10 @@ func NewClient(ctx log.Interface, id, username, password string, brokers ...stri
 
 	ttnClient.opts.SetOnConnectHandler(func(client MQTT.Client) {
 		ctx.Info("mqtt: connected")
+		// On the first connection, Connect subscribes to the registered topics itself
 		if reconnecting {
-			for topic, handler := range ttnClient.subscriptions {
-				ctx.Infof("mqtt: re-subscribing to topic: %s", topic)
-				ttnClient.subscribe(topic, handler)
-			}
+			<-time.After(resubscribeDelay())
+			ttnClient.subscribeAll()
 			reconnecting = false
 		}
 	})
@@ -203,53 +212,241 @@ func NewClient(ctx log.Interface, id, username, password string, brokers ...stri
 	return ttnClient
 }
 
+// ResubscribeJitter is the maximum random delay before the client re-subscribes to its topics after a reconnect.
+// This spreads the re-subscriptions of many clients that reconnect at the same time.
+var ResubscribeJitter time.Duration
+
+func resubscribeDelay() time.Duration {
+	if ResubscribeJitter <= 0 {
+		return 0
+	}
+	return time.Duration(random.Intn(int(ResubscribeJitter)))
+}
+
+// SetWill configures the message that the broker publishes on the given topic if the client disconnects
+// ungracefully. It returns an error if the client is already connected.
+func (c *DefaultClient) SetWill(topic string, payload []byte, qos byte, retained bool) error {
+	if c.mqtt.IsConnected() {
+		return fmt.Errorf("Could not set will: the client is already connected")
+	}
+	c.opts.SetBinaryWill(topic, payload, qos, retained)
+	c.mqtt = MQTT.NewClient(c.opts)
+	return nil
+}
+
 var (
 	// ConnectRetries says how many times the client should retry a failed connection
 	ConnectRetries = 10
 	// ConnectRetryDelay says how long the client should wait between retries
 	ConnectRetryDelay = time.Second
+	// ConnectRetryJitter says by which fraction (between 0 and 1) ConnectRetryDelay is randomly varied.
+	// It only applies to the retries in Connect, not to paho's automatic reconnect.
+	ConnectRetryJitter = 0.0
+	// MaxReconnectInterval says how long the client may wait between attempts to restore a lost connection.
+	// It must be at least one second, the interval that paho starts with.
+	MaxReconnectInterval = 10 * time.Minute
+	// ConnectTimeout says how long the client should wait for a connection attempt to complete. Zero means that
+	// it waits indefinitely.
+	ConnectTimeout = 30 * time.Second
+	// SubscribeTimeout says how long the client should wait for the broker to acknowledge the subscriptions it
+	// makes when (re)connecting. Zero means that it waits indefinitely.
+	SubscribeTimeout = 10 * time.Second
+	// PublishTimeout says how long the client should wait for the broker to acknowledge a publish that it makes
+	// on behalf of a single call, such as the fields of PublishUplinkFields. Zero means that it waits indefinitely.
+	PublishTimeout = 10 * time.Second
+	// KeepAlive says how long the client may be idle before it pings the broker. Zero disables the pings.
+	KeepAlive = 30 * time.Second
+	// PingTimeout says how long the client should wait for a ping response before it considers the connection
+	// lost. It must be positive.
+	PingTimeout = 10 * time.Second
 )
 
-// Connect to the MQTT broker. It will retry for ConnectRetries times with a delay of ConnectRetryDelay between retries
+// minReconnectInterval is the interval that paho waits before its first attempt to restore a lost connection
+const minReconnectInterval = time.Second
+
+// waitToken waits for the token to complete, or at most for the timeout if it is not zero
+func waitToken(token Token, timeout time.Duration) bool {
+	if timeout == 0 {
+		return token.Wait()
+	}
+	return token.WaitTimeout(timeout)
+}
+
+// checkConfig returns an error if one of the connection settings has an invalid value
+func checkConfig() error {
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"ConnectRetryDelay", ConnectRetryDelay},
+		{"ConnectTimeout", ConnectTimeout},
+		{"KeepAlive", KeepAlive},
+		{"PingTimeout", PingTimeout},
+	}
+	for _, duration := range durations {
+		if duration.value < 0 {
+			return fmt.Errorf("Invalid %s %s: must not be negative", duration.name, duration.value)
+		}
+	}
+	if PingTimeout == 0 {
+		return fmt.Errorf("Invalid PingTimeout %s: must be positive", PingTimeout)
+	}
+	if ConnectRetryJitter < 0 || ConnectRetryJitter > 1 {
+		return fmt.Errorf("Invalid ConnectRetryJitter %v: must be between 0 and 1", ConnectRetryJitter)
+	}
+	if MaxReconnectInterval < minReconnectInterval {
+		return fmt.Errorf("Invalid MaxReconnectInterval %s: must be at least %s", MaxReconnectInterval, minReconnectInterval)
+	}
+	return nil
+}
+
+func connectRetryDelay() time.Duration {
+	jitter := time.Duration(float64(ConnectRetryDelay) * ConnectRetryJitter)
+	if jitter <= 0 {
+		return ConnectRetryDelay
+	}
+	return ConnectRetryDelay - jitter + time.Duration(random.Intn(int(2*jitter)))
+}
+
+// Connect to the MQTT broker. It will retry for ConnectRetries times with a delay of ConnectRetryDelay between retries.
+// Connection attempts that do not complete within ConnectTimeout are considered failed, unless ConnectTimeout is zero.
+// It returns an error without connecting if one of the connection settings has an invalid value.
+// Once connected, it subscribes to the topics that were registered before the connection was made. If any of
+// these subscriptions fails, it disconnects and returns an error.
 func (c *DefaultClient) Connect() error {
 	if c.mqtt.IsConnected() {
 		return nil
 	}
+	if err := checkConfig(); err != nil {
+		return err
+	}
 	var err error
 	for retries := 0; retries < ConnectRetries; retries++ {
 		token := c.mqtt.Connect()
-		finished := token.WaitTimeout(1 * time.Second)
-		if !finished {
+		warnAfter := 1 * time.Second
+		if ConnectTimeout != 0 && warnAfter > ConnectTimeout {
+			warnAfter = ConnectTimeout
+		}
+		finished := token.WaitTimeout(warnAfter)
+		if !finished && (ConnectTimeout == 0 || warnAfter < ConnectTimeout) {
 			c.ctx.Warn("mqtt: connection took longer than expected...")
-			token.Wait()
+			if ConnectTimeout == 0 {
+				finished = token.Wait()
+			} else {
+				finished = token.WaitTimeout(ConnectTimeout - warnAfter)
+			}
+		}
+		if finished {
+			err = token.Error()
+		} else {
+			// paho can not abort a pending connection attempt, so the next attempt uses a new client
+			c.mqtt = MQTT.NewClient(c.opts)
+			err = fmt.Errorf("connection did not complete within %s", ConnectTimeout)
 		}
-		err = token.Error()
 		if err == nil {
 			break
 		}
 		c.ctx.Warnf("mqtt: could not connect (%s), retrying...", err)
-		<-time.After(ConnectRetryDelay)
+		<-time.After(connectRetryDelay())
 	}
 	if err != nil {
 		return fmt.Errorf("Could not connect to MQTT Broker (%s)", err)
 	}
+	if err := c.subscribeAll(); err != nil {
+		// Disconnect so that the subscriptions are retried by the next Connect
+		c.Disconnect()
+		return err
+	}
+	return nil
+}
+
+// subscribeAll subscribes to all registered topics and returns the first error that occurred
+func (c *DefaultClient) subscribeAll() error {
+	c.subscriptionsLock.RLock()
+	subscriptions := make(map[string]MQTT.MessageHandler, len(c.subscriptions))
+	for topic, handler := range c.subscriptions {
+		subscriptions[topic] = handler
+	}
+	c.subscriptionsLock.RUnlock()
+
+	var firstErr error
+	for topic, handler := range subscriptions {
+		c.ctx.Infof("mqtt: subscribing to topic: %s", topic)
+		var err error
+		token := c.mqtt.Subscribe(topic, SubscribeQoS, handler)
+		if waitToken(token, SubscribeTimeout) {
+			err = token.Error()
+		} else {
+			err = fmt.Errorf("subscription did not complete within %s", SubscribeTimeout)
+		}
+		if err != nil {
+			c.ctx.Warnf("mqtt: could not subscribe to topic %s (%s)", topic, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Could not subscribe to topic %s (%s)", topic, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// maxLoggedTopicLength is the number of bytes of an oversized topic that is included in errors
+const maxLoggedTopicLength = 64
+
+func checkTopicLength(topic string) error {
+	if len(topic) > MaxTopicLength {
+		logged := topic
+		if len(logged) > maxLoggedTopicLength {
+			logged = logged[:maxLoggedTopicLength] + "..."
+		}
+		return fmt.Errorf("Topic %s (%d bytes) exceeds the maximum length of %d bytes", logged, len(topic), MaxTopicLength)
+	}
 	return nil
 }
 
 func (c *DefaultClient) publish(topic string, msg []byte) Token {
+	if err := checkTopicLength(topic); err != nil {
+		return &simpleToken{err}
+	}
 	return c.mqtt.Publish(topic, PublishQoS, false, msg)
 }
 
+// subscribe registers the handler for the topic. If the client is not connected yet,
+// the subscription is made by Connect.
 func (c *DefaultClient) subscribe(topic string, handler MQTT.MessageHandler) Token {
+	if err := checkTopicLength(topic); err != nil {
+		return &simpleToken{err}
+	}
+	c.subscriptionsLock.Lock()
 	c.subscriptions[topic] = handler
+	c.subscriptionsLock.Unlock()
+	if !c.mqtt.IsConnected() {
+		return &simpleToken{}
+	}
 	return c.mqtt.Subscribe(topic, SubscribeQoS, handler)
 }
 
 func (c *DefaultClient) unsubscribe(topic string) Token {
+	c.subscriptionsLock.Lock()
 	delete(c.subscriptions, topic)
+	c.subscriptionsLock.Unlock()
+	if !c.mqtt.IsConnected() {
+		return &simpleToken{}
+	}
 	return c.mqtt.Unsubscribe(topic)
 }
 
+// Subscriptions returns a sorted list of the topics that the client is subscribed to
+func (c *DefaultClient) Subscriptions() []string {
+	c.subscriptionsLock.RLock()
+	defer c.subscriptionsLock.RUnlock()
+	topics := make([]string, 0, len(c.subscriptions))
+	for topic := range c.subscriptions {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
 // Disconnect from the MQTT broker
 func (c *DefaultClient) Disconnect() {
 	if !c.mqtt.IsConnected() {
@@ -7,12 +7,16 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/TheThingsNetwork/go-utils/log/apex"
 	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/TheThingsNetwork/ttn/utils/testing"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
 	. "github.com/smartystreets/assertions"
 )
 
@@ -79,6 +83,87 @@ func TestNewClient(t *testing.T) {
 	a.So(c.(*DefaultClient).mqtt, ShouldNotBeNil)
 }
 
+func TestNewClientTimeouts(t *testing.T) {
+	a := New(t)
+
+	defer func(keepAlive, pingTimeout, connectTimeout time.Duration) {
+		KeepAlive, PingTimeout, ConnectTimeout = keepAlive, pingTimeout, connectTimeout
+	}(KeepAlive, PingTimeout, ConnectTimeout)
+	KeepAlive = 5 * time.Second
+	PingTimeout = 2 * time.Second
+	ConnectTimeout = 3 * time.Second
+
+	c := NewClient(getLogger(t, "Test"), "test", "", "", fmt.Sprintf("tcp://%s", host)).(*DefaultClient)
+	a.So(c.opts.KeepAlive, ShouldEqual, 5*time.Second)
+	a.So(c.opts.PingTimeout, ShouldEqual, 2*time.Second)
+	a.So(c.opts.ConnectTimeout, ShouldEqual, 3*time.Second)
+	a.So(c.opts.MaxReconnectInterval, ShouldEqual, MaxReconnectInterval)
+}
+
+func TestConnectNegativeTimeouts(t *testing.T) {
+	a := New(t)
+
+	defer func(keepAlive, pingTimeout, connectTimeout time.Duration) {
+		KeepAlive, PingTimeout, ConnectTimeout = keepAlive, pingTimeout, connectTimeout
+	}(KeepAlive, PingTimeout, ConnectTimeout)
+
+	for _, tt := range []struct {
+		setting *time.Duration
+		value   time.Duration
+		err     string
+	}{
+		{&KeepAlive, -1 * time.Second, "must not be negative"},
+		{&PingTimeout, -1 * time.Second, "must not be negative"},
+		{&ConnectTimeout, -1 * time.Second, "must not be negative"},
+		{&PingTimeout, 0, "must be positive"},
+		{&KeepAlive, 0, ""},
+		{&ConnectTimeout, 0, ""},
+	} {
+		original := *tt.setting
+		*tt.setting = tt.value
+
+		c := NewClient(getLogger(t, "Test"), "test", "", "", fmt.Sprintf("tcp://%s", host))
+		fake := &fakeClient{connectToken: fakeToken{complete: true}}
+		c.(*DefaultClient).mqtt = fake
+		err := c.Connect()
+		if tt.err == "" {
+			a.So(err, ShouldBeNil)
+			a.So(fake.connects, ShouldEqual, 1)
+		} else {
+			a.So(err, ShouldNotBeNil)
+			a.So(err.Error(), ShouldContainSubstring, tt.err)
+			a.So(fake.connects, ShouldEqual, 0)
+		}
+
+		*tt.setting = original
+	}
+}
+
+func TestSetWill(t *testing.T) {
+	a := New(t)
+	c := NewClient(getLogger(t, "Test"), "test", "", "", fmt.Sprintf("tcp://%s", host)).(*DefaultClient)
+	a.So(c.opts.WillEnabled, ShouldBeFalse)
+
+	err := c.SetWill("test/status", []byte("offline"), 1, true)
+	a.So(err, ShouldBeNil)
+	a.So(c.opts.WillEnabled, ShouldBeTrue)
+	a.So(c.opts.WillTopic, ShouldEqual, "test/status")
+	a.So(c.opts.WillPayload, ShouldResemble, []byte("offline"))
+	a.So(c.opts.WillQos, ShouldEqual, 1)
+	a.So(c.opts.WillRetained, ShouldBeTrue)
+
+	err = c.Connect()
+	defer c.Disconnect()
+	a.So(err, ShouldBeNil)
+
+	// Setting the will on a connected client would orphan its connection
+	connected := c.mqtt
+	err = c.SetWill("test/status", []byte("gone"), 1, true)
+	a.So(err, ShouldNotBeNil)
+	a.So(c.mqtt, ShouldEqual, connected)
+	a.So(c.IsConnected(), ShouldBeTrue)
+}
+
 func TestConnect(t *testing.T) {
 	a := New(t)
 	c := NewClient(getLogger(t, "Test"), "test", "", "", fmt.Sprintf("tcp://%s", host))
@@ -123,6 +208,201 @@ func TestConnectInvalidAddress(t *testing.T) {
 	a.So(err, ShouldNotBeNil)
 }
 
+// fakeClient is an MQTT client that completes or fails connections, subscriptions and publishes with the
+// configured tokens
+type fakeClient struct {
+	MQTT.Client
+	connectToken   fakeToken
+	subscribeToken fakeToken
+	publishToken   fakeToken
+	connected      bool
+	connects       int
+	disconnects    int
+	subscribed     []string
+}
+
+func (c *fakeClient) Connect() MQTT.Token {
+	c.connects++
+	c.connected = c.connectToken.complete && c.connectToken.err == nil
+	return c.connectToken
+}
+func (c *fakeClient) IsConnected() bool { return c.connected }
+func (c *fakeClient) Disconnect(quiesce uint) {
+	c.disconnects++
+	c.connected = false
+}
+func (c *fakeClient) Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token {
+	c.subscribed = append(c.subscribed, topic)
+	return c.subscribeToken
+}
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	return c.publishToken
+}
+
+// fakeToken is an MQTT token that completes with err, or never completes
+type fakeToken struct {
+	MQTT.Token
+	complete bool
+	err      error
+}
+
+func (t fakeToken) Wait() bool {
+	if !t.complete {
+		select {}
+	}
+	return true
+}
+func (t fakeToken) WaitTimeout(d time.Duration) bool {
+	if !t.complete {
+		<-time.After(d)
+	}
+	return t.complete
+}
+func (t fakeToken) Error() error { return t.err }
+
+func TestConnectSubscribeError(t *testing.T) {
+	a := New(t)
+
+	defer func(timeout time.Duration) { SubscribeTimeout = timeout }(SubscribeTimeout)
+	SubscribeTimeout = 50 * time.Millisecond
+
+	c := NewClient(getLogger(t, "Test"), "test", "", "", fmt.Sprintf("tcp://%s", host))
+	c.SubscribeDeviceUplink("app12", "dev1", func(client Client, appID string, devID string, req types.UplinkMessage) {})
+
+	fake := &fakeClient{
+		connectToken:   fakeToken{complete: true},
+		subscribeToken: fakeToken{complete: true, err: errors.New("Not authorized")},
+	}
+	c.(*DefaultClient).mqtt = fake
+	err := c.Connect()
+	a.So(err, ShouldNotBeNil)
+	a.So(err.Error(), ShouldContainSubstring, "Not authorized")
+	a.So(fake.subscribed, ShouldResemble, []string{"app12/devices/dev1/up"})
+	a.So(fake.disconnects, ShouldEqual, 1)
+	a.So(c.IsConnected(), ShouldBeFalse)
+
+	// The next Connect retries the subscription
+	fake.subscribeToken = fakeToken{complete: true}
+	err = c.Connect()
+	a.So(err, ShouldBeNil)
+	a.So(fake.subscribed, ShouldResemble, []string{"app12/devices/dev1/up", "app12/devices/dev1/up"})
+
+	fake = &fakeClient{
+		connectToken:   fakeToken{complete: true},
+		subscribeToken: fakeToken{complete: false},
+	}
+	c.(*DefaultClient).mqtt = fake
+	err = c.Connect()
+	a.So(err, ShouldNotBeNil)
+	a.So(err.Error(), ShouldContainSubstring, "did not complete")
+}
+
+func TestConnectTimeout(t *testing.T) {
+	a := New(t)
+
+	defer func(retries int, delay, timeout time.Duration) {
+		ConnectRetries, ConnectRetryDelay, ConnectTimeout = retries, delay, timeout
+	}(ConnectRetries, ConnectRetryDelay, ConnectTimeout)
+	ConnectRetries = 2
+	ConnectRetryDelay = 0
+	ConnectTimeout = 50 * time.Millisecond
+
+	// A broker that accepts connections, but never sends a CONNACK
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer lis.Close()
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	c := NewClient(getLogger(t, "Test"), "test", "", "", fmt.Sprintf("tcp://%s", lis.Addr()))
+	start := time.Now()
+	err = c.Connect()
+	a.So(err, ShouldNotBeNil)
+	a.So(err.Error(), ShouldContainSubstring, "connection did not complete within 50ms")
+	a.So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+	a.So(c.IsConnected(), ShouldBeFalse)
+
+	// Every attempt made its own connection
+	for i := 0; i < 2; i++ {
+		select {
+		case conn := <-accepted:
+			conn.Close()
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("Expected 2 connection attempts, got %d", i)
+		}
+	}
+}
+
+func TestConnectRetryDelay(t *testing.T) {
+	a := New(t)
+
+	defer func(delay time.Duration, jitter float64) {
+		ConnectRetryDelay, ConnectRetryJitter = delay, jitter
+	}(ConnectRetryDelay, ConnectRetryJitter)
+	ConnectRetryDelay = 100 * time.Millisecond
+
+	ConnectRetryJitter = 0
+	a.So(connectRetryDelay(), ShouldEqual, 100*time.Millisecond)
+
+	ConnectRetryJitter = 0.2
+	for i := 0; i < 100; i++ {
+		delay := connectRetryDelay()
+		a.So(delay, ShouldBeGreaterThanOrEqualTo, 80*time.Millisecond)
+		a.So(delay, ShouldBeLessThan, 120*time.Millisecond)
+	}
+
+	ConnectRetryJitter = 1
+	for i := 0; i < 100; i++ {
+		delay := connectRetryDelay()
+		a.So(delay, ShouldBeGreaterThanOrEqualTo, 0)
+		a.So(delay, ShouldBeLessThan, 200*time.Millisecond)
+	}
+}
+
+func TestConnectInvalidRetrySettings(t *testing.T) {
+	a := New(t)
+
+	defer func(delay time.Duration, jitter float64, maxInterval time.Duration) {
+		ConnectRetryDelay, ConnectRetryJitter, MaxReconnectInterval = delay, jitter, maxInterval
+	}(ConnectRetryDelay, ConnectRetryJitter, MaxReconnectInterval)
+
+	tests := []struct {
+		delay       time.Duration
+		jitter      float64
+		maxInterval time.Duration
+		err         string
+	}{
+		{time.Second, -0.1, time.Minute, "ConnectRetryJitter"},
+		{time.Second, 1.5, time.Minute, "ConnectRetryJitter"},
+		{time.Second, 0.5, 500 * time.Millisecond, "MaxReconnectInterval"},
+		{0, 0, 0, "MaxReconnectInterval"},
+		{0, 0, -1 * time.Second, "MaxReconnectInterval"},
+	}
+	for _, test := range tests {
+		ConnectRetryDelay = test.delay
+		ConnectRetryJitter = test.jitter
+		MaxReconnectInterval = test.maxInterval
+
+		c := NewClient(getLogger(t, "Test"), "test", "", "", fmt.Sprintf("tcp://%s", host))
+		fake := &fakeClient{connectToken: fakeToken{complete: true}}
+		c.(*DefaultClient).mqtt = fake
+		err := c.Connect()
+		a.So(err, ShouldNotBeNil)
+		a.So(err.Error(), ShouldContainSubstring, test.err)
+		a.So(fake.connects, ShouldEqual, 0)
+	}
+}
+
 func TestConnectInvalidCredentials(t *testing.T) {
 	t.Skipf("Need authenticated MQTT for TestConnectInvalidCredentials - Skipping")
 }
@@ -172,6 +452,96 @@ func TestRandomTopicPublish(t *testing.T) {
 	ctx.Info("This test should have printed one message.")
 }
 
+func TestSubscribeBeforeConnect(t *testing.T) {
+	a := New(t)
+	c := NewClient(getLogger(t, "Test"), "test", "", "", fmt.Sprintf("tcp://%s", host))
+
+	var wg WaitGroup
+
+	wg.Add(1)
+
+	subToken := c.SubscribeDeviceUplink("app9", "dev1", func(client Client, appID string, devID string, req types.UplinkMessage) {
+		a.So(appID, ShouldEqual, "app9")
+		a.So(devID, ShouldEqual, "dev1")
+		wg.Done()
+	})
+	waitForOK(subToken, a)
+
+	err := c.Connect()
+	defer c.Disconnect()
+	a.So(err, ShouldBeNil)
+
+	pubToken := c.PublishUplink(types.UplinkMessage{
+		AppID:      "app9",
+		DevID:      "dev1",
+		PayloadRaw: []byte{0x01, 0x02, 0x03, 0x04},
+	})
+	waitForOK(pubToken, a)
+
+	a.So(wg.WaitFor(200*time.Millisecond), ShouldBeNil)
+
+	unsubToken := c.UnsubscribeDeviceUplink("app9", "dev1")
+	waitForOK(unsubToken, a)
+}
+
+func TestResubscribeDelay(t *testing.T) {
+	a := New(t)
+
+	defer func(jitter time.Duration) { ResubscribeJitter = jitter }(ResubscribeJitter)
+
+	ResubscribeJitter = 0
+	a.So(resubscribeDelay(), ShouldEqual, 0)
+
+	ResubscribeJitter = 10 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		delay := resubscribeDelay()
+		a.So(delay, ShouldBeGreaterThanOrEqualTo, 0)
+		a.So(delay, ShouldBeLessThan, ResubscribeJitter)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	a := New(t)
+	c := NewClient(getLogger(t, "Test"), "test", "", "", fmt.Sprintf("tcp://%s", host)).(*DefaultClient)
+	a.So(c.Subscriptions(), ShouldBeEmpty)
+
+	c.SubscribeDeviceUplink("app11", "dev2", func(client Client, appID string, devID string, req types.UplinkMessage) {})
+	c.SubscribeDeviceUplink("app11", "dev1", func(client Client, appID string, devID string, req types.UplinkMessage) {})
+	topics := c.Subscriptions()
+	a.So(topics, ShouldResemble, []string{"app11/devices/dev1/up", "app11/devices/dev2/up"})
+
+	topics[0] = "modified"
+	a.So(c.Subscriptions(), ShouldResemble, []string{"app11/devices/dev1/up", "app11/devices/dev2/up"})
+
+	c.UnsubscribeDeviceUplink("app11", "dev1")
+	a.So(c.Subscriptions(), ShouldResemble, []string{"app11/devices/dev2/up"})
+}
+
+func TestMaxTopicLength(t *testing.T) {
+	a := New(t)
+	c := NewClient(getLogger(t, "Test"), "test", "", "", fmt.Sprintf("tcp://%s", host))
+	c.Connect()
+	defer c.Disconnect()
+
+	defer func(length int) { MaxTopicLength = length }(MaxTopicLength)
+	MaxTopicLength = len("app10/devices/dev1/up")
+
+	pubToken := c.PublishUplink(types.UplinkMessage{AppID: "app10", DevID: "dev1"})
+	waitForOK(pubToken, a)
+
+	pubToken = c.PublishUplink(types.UplinkMessage{AppID: "app10", DevID: "dev10"})
+	a.So(pubToken.Error(), ShouldNotBeNil)
+
+	subToken := c.SubscribeDeviceUplink("app10", "dev10", func(client Client, appID string, devID string, req types.UplinkMessage) {})
+	a.So(subToken.Error(), ShouldNotBeNil)
+	a.So(c.(*DefaultClient).subscriptions, ShouldNotContainKey, "app10/devices/dev10/up")
+
+	topic := strings.Repeat("a", 1000)
+	err := checkTopicLength(topic)
+	a.So(err, ShouldNotBeNil)
+	a.So(len(err.Error()), ShouldBeLessThan, 200)
+}
+
 func ExampleNewClient() {
 	ctx := apex.Stdout().WithField("Example", "NewClient")
 	exampleClient := NewClient(ctx, "ttnctl", "my-app-id", "my-access-key", "eu.thethings.network:1883")
@@ -38,7 +38,11 @@ func (c *DefaultClient) PublishUplinkFields(appID string, devID string, fields m
 	t := newToken()
 	go func() {
 		for _, token := range tokens {
-			token.Wait()
+			if !waitToken(token, PublishTimeout) {
+				c.ctx.Warnf("mqtt: timeout while publishing uplink fields")
+				t.err = fmt.Errorf("publish did not complete within %s", PublishTimeout)
+				continue
+			}
 			if token.Error() != nil {
 				c.ctx.Warnf("mqtt: error publishing uplink fields: %s", token.Error())
 				t.err = token.Error()
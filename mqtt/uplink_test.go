@@ -105,6 +105,21 @@ func TestPublishUplinkFields(t *testing.T) {
 	}
 }
 
+func TestPublishUplinkFieldsTimeout(t *testing.T) {
+	a := New(t)
+
+	defer func(timeout time.Duration) { PublishTimeout = timeout }(PublishTimeout)
+	PublishTimeout = 50 * time.Millisecond
+
+	c := NewClient(getLogger(t, "Test"), "test", "", "", fmt.Sprintf("tcp://%s", host))
+	c.(*DefaultClient).mqtt = &fakeClient{publishToken: fakeToken{complete: false}}
+
+	token := c.PublishUplinkFields("fields-app", "fields-dev", map[string]interface{}{"battery": 90, "gps": true})
+	a.So(token.WaitTimeout(time.Second), ShouldBeTrue)
+	a.So(token.Error(), ShouldNotBeNil)
+	a.So(token.Error().Error(), ShouldContainSubstring, "did not complete within 50ms")
+}
+
 func TestSubscribeDeviceUplink(t *testing.T) {
 	a := New(t)
 	c := NewClient(getLogger(t, "Test"), "test", "", "", fmt.Sprintf("tcp://%s", host))
@@ -9,6 +9,7 @@ import (
 
 	"github.com/TheThingsNetwork/api"
 	"github.com/TheThingsNetwork/ttn/core/types"
+	"github.com/TheThingsNetwork/ttn/mqtt"
 	"github.com/TheThingsNetwork/ttn/ttnctl/util"
 	"github.com/spf13/cobra"
 )
@@ -97,7 +98,9 @@ $ ttnctl downlink test --json '{"led":"on"}'
 			message.PayloadRaw = payload
 		}
 		token := client.PublishDownlink(message)
-		token.Wait()
+		if !token.WaitTimeout(mqtt.PublishTimeout) {
+			ctx.Fatal("Timeout while enqueueing downlink")
+		}
 		if token.Error() != nil {
 			ctx.WithError(token.Error()).Fatal("Could not enqueue downlink")
 		}
@@ -40,7 +40,9 @@ var subscribeCmd = &cobra.Command{
 			printKV("DevAddr", req.DevAddr)
 			fmt.Println()
 		})
-		token.Wait()
+		if !token.WaitTimeout(mqtt.SubscribeTimeout) {
+			ctx.Fatal("Timeout while subscribing to activations")
+		}
 		if err := token.Error(); err != nil {
 			ctx.WithError(err).Fatal("Could not subscribe to activations")
 		}
@@ -61,7 +63,9 @@ var subscribeCmd = &cobra.Command{
 			}
 			fmt.Println()
 		})
-		token.Wait()
+		if !token.WaitTimeout(mqtt.SubscribeTimeout) {
+			ctx.Fatal("Timeout while subscribing to uplink")
+		}
 		if err := token.Error(); err != nil {
 			ctx.WithError(err).Fatal("Could not subscribe to uplink")
 		}